@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// loadBalancingPolicy selects the algorithm cluster.getHost uses to pick a
+// host. Configured per cluster via load_balancing_policy.
+type loadBalancingPolicy int
+
+const (
+	// leastLoaded is the original algorithm: round-robin scan picking the
+	// host with the fewest running queries
+	leastLoaded loadBalancingPolicy = iota
+	roundRobin
+	p2cEWMA
+)
+
+const defaultEWMADecay = 10 * time.Second
+
+func (p loadBalancingPolicy) String() string {
+	switch p {
+	case roundRobin:
+		return "round_robin"
+	case p2cEWMA:
+		return "p2c_ewma"
+	default:
+		return "least_loaded"
+	}
+}
+
+// parseLoadBalancingPolicy parses the load_balancing_policy config value
+func parseLoadBalancingPolicy(s string) (loadBalancingPolicy, error) {
+	switch s {
+	case "", "least_loaded":
+		return leastLoaded, nil
+	case "round_robin":
+		return roundRobin, nil
+	case "p2c_ewma":
+		return p2cEWMA, nil
+	default:
+		return leastLoaded, fmt.Errorf("unknown load_balancing_policy %q", s)
+	}
+}
+
+// eligibleHosts returns the hosts getHost/getHostExcluding should choose
+// among: healthy, non-excluded hosts, falling back to every non-excluded,
+// non-draining host if none are currently healthy. A draining host is never
+// eligible, healthy or not: it's being deliberately evacuated, so routing a
+// query there would just end up rejected once host.limiter sees it.
+func (c *cluster) eligibleHosts(excluded map[*host]bool) []*host {
+	healthy := make([]*host, 0, len(c.hosts))
+	all := make([]*host, 0, len(c.hosts))
+	for _, h := range c.hosts {
+		if excluded[h] || h.isDraining() {
+			continue
+		}
+		all = append(all, h)
+		if h.isHealthy() {
+			healthy = append(healthy, h)
+		}
+	}
+
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return all
+}
+
+func (c *cluster) selectHost(hosts []*host) *host {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	switch c.loadBalancing {
+	case roundRobin:
+		return c.pickRoundRobin(hosts)
+	case p2cEWMA:
+		return pickP2CEWMA(hosts)
+	default:
+		return c.pickLeastLoaded(hosts)
+	}
+}
+
+func (c *cluster) pickRoundRobin(hosts []*host) *host {
+	idx := atomic.AddUint32(&c.nextIdx, 1) % uint32(len(hosts))
+	return hosts[idx]
+}
+
+// pickLeastLoaded walks hosts starting from a round-robin cursor and
+// returns the one with the fewest running queries
+func (c *cluster) pickLeastLoaded(hosts []*host) *host {
+	l := uint32(len(hosts))
+	idx := atomic.AddUint32(&c.nextIdx, 1) % l
+
+	idle := hosts[idx]
+	idleN := idle.runningQueries()
+	if idleN == 0 {
+		return idle
+	}
+
+	for i := (idx + 1) % l; i != idx; i = (i + 1) % l {
+		h := hosts[i]
+		n := h.runningQueries()
+		if n == 0 {
+			return h
+		}
+		if n < idleN {
+			idle, idleN = h, n
+		}
+	}
+
+	return idle
+}
+
+// pickP2CEWMA implements power-of-two-choices: sample two hosts at random
+// and keep the one with the lower (runningQueries+1) * ewmaLatency score
+// (see hostScore). O(1)
+// regardless of cluster size, and naturally avoids hosts that are either
+// overloaded or currently slow (GC pauses, merges, long queries).
+func pickP2CEWMA(hosts []*host) *host {
+	if len(hosts) == 1 {
+		return hosts[0]
+	}
+
+	i := rand.Intn(len(hosts))
+	j := rand.Intn(len(hosts) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := hosts[i], hosts[j]
+	if hostScore(a) <= hostScore(b) {
+		return a
+	}
+	return b
+}
+
+func hostScore(h *host) float64 {
+	lat := h.latency()
+	if lat <= 0 {
+		// no samples yet - treat as a fast, but not free, host so it
+		// still gets picked ahead of ones known to be slow
+		lat = time.Millisecond
+	}
+
+	return float64(h.runningQueries()+1) * float64(lat)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPickP2CEWMASingleHost(t *testing.T) {
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+	if got := pickP2CEWMA([]*host{h}); got != h {
+		t.Fatalf("pickP2CEWMA with a single host = %v; want %v", got, h)
+	}
+}
+
+func TestPickP2CEWMAPicksLowerScore(t *testing.T) {
+	slow := newHost(mustParseURL(t, "http://slow/"))
+	slow.recordLatency(500*time.Millisecond, time.Second)
+
+	fast := newHost(mustParseURL(t, "http://fast/"))
+	fast.recordLatency(time.Millisecond, time.Second)
+
+	// with only two hosts in play, p2c always samples both, so the
+	// outcome is deterministic: the lower-scored host always wins
+	for i := 0; i < 20; i++ {
+		if got := pickP2CEWMA([]*host{slow, fast}); got != fast {
+			t.Fatalf("pickP2CEWMA([slow, fast]) = %v; want the lower-scored host %v", got.addr, fast.addr)
+		}
+		if got := pickP2CEWMA([]*host{fast, slow}); got != fast {
+			t.Fatalf("pickP2CEWMA([fast, slow]) = %v; want the lower-scored host %v", got.addr, fast.addr)
+		}
+	}
+}
+
+func TestPickP2CEWMATieReturnsOneOfTheHosts(t *testing.T) {
+	a := newHost(mustParseURL(t, "http://a/"))
+	b := newHost(mustParseURL(t, "http://b/"))
+
+	for i := 0; i < 20; i++ {
+		got := pickP2CEWMA([]*host{a, b})
+		if got != a && got != b {
+			t.Fatalf("pickP2CEWMA with tied scores returned a host outside the input set: %v", got)
+		}
+	}
+}
+
+func TestHostScoreTreatsUnsampledLatencyAsFast(t *testing.T) {
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+	if lat := h.latency(); lat != 0 {
+		t.Fatalf("expected a fresh host to have no latency samples, got %s", lat)
+	}
+
+	// a host with no samples yet should still get a usable (low, non-zero)
+	// score rather than e.g. winning every comparison via a zero score
+	if score := hostScore(h); score <= 0 {
+		t.Fatalf("hostScore() = %f; want > 0", score)
+	}
+}
+
+func TestHostRecordLatencyFirstSampleSetsBaseline(t *testing.T) {
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+	h.recordLatency(50*time.Millisecond, time.Second)
+
+	if got := h.latency(); got != 50*time.Millisecond {
+		t.Fatalf("latency() after first sample = %s; want %s", got, 50*time.Millisecond)
+	}
+}
+
+func TestHostRecordLatencyFullyDecaysAfterDecayWindow(t *testing.T) {
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+
+	h.recordLatency(10*time.Millisecond, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	h.recordLatency(40*time.Millisecond, time.Millisecond)
+
+	if got := h.latency(); got != 40*time.Millisecond {
+		t.Fatalf("latency() after waiting past the decay window = %s; want the new sample %s", got, 40*time.Millisecond)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hagen1778/chproxy/log"
+)
+
+// resourceExhaustedStatus is the HTTP status code returned to clients whose
+// request was rejected by a Limiter. Overridable so operators can return a
+// custom "resource exhausted" status instead of the default 429.
+var resourceExhaustedStatus = http.StatusTooManyRequests
+
+// errResourceExhausted marks an error as originating from a Limiter rather
+// than a static maxConcurrentQueries check, so the HTTP layer can respond
+// with resourceExhaustedStatus instead of a generic error status.
+type errResourceExhausted struct {
+	error
+}
+
+const defaultDrainRate = 5 * time.Second
+
+// drainHost takes host out of rotation and starts evacuating its in-flight
+// queries: the host stops receiving new requests immediately, and a
+// `KILL QUERY` is issued against it on the given schedule until no queries
+// remain running on it.
+func (c *cluster) drainHost(addr string, rate time.Duration) error {
+	var h *host
+	for _, candidate := range c.hosts {
+		if candidate.addr.Host == addr {
+			h = candidate
+			break
+		}
+	}
+	if h == nil {
+		return fmt.Errorf("cluster %q has no host %q", c.name, addr)
+	}
+
+	if rate <= 0 {
+		rate = defaultDrainRate
+	}
+
+	h.setDraining(true)
+	h.setHealthy(false)
+	h.limiter.SetMax(0)
+
+	go func() {
+		ticker := time.NewTicker(rate)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if h.runningQueries() == 0 {
+				log.Infof("cluster %q: host %q drained", c.name, h.addr.Host)
+				return
+			}
+			if err := c.killAllQueriesOnHost(h); err != nil {
+				log.Errorf("cluster %q: error draining host %q: %s", c.name, h.addr.Host, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// handleDrain serves `/drain?host=<addr>&rate=<duration>`, an admin-only
+// endpoint that triggers drainHost for the cluster owning the given host.
+func handleDrain(clusters map[string]*cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := r.URL.Query().Get("host")
+		if addr == "" {
+			http.Error(w, "missing required `host` param", http.StatusBadRequest)
+			return
+		}
+
+		rate := defaultDrainRate
+		if s := r.URL.Query().Get("rate"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid `rate` param: %s", err), http.StatusBadRequest)
+				return
+			}
+			rate = d
+		}
+
+		for _, c := range clusters {
+			for _, h := range c.hosts {
+				if h.addr.Host == addr {
+					if err := c.drainHost(addr, rate); err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+					}
+					return
+				}
+			}
+		}
+
+		http.Error(w, fmt.Sprintf("no such host %q in any cluster", addr), http.StatusNotFound)
+	}
+}
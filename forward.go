@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/hagen1778/chproxy/log"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 2 * time.Second
+)
+
+// idempotentPrefixes lists the statement types that are safe to retry
+// against a different host without risking a double execution
+var idempotentPrefixes = [][]byte{
+	[]byte("SELECT"),
+	[]byte("SHOW"),
+	[]byte("DESCRIBE"),
+	[]byte("EXISTS"),
+}
+
+// isIdempotentQuery reports whether query is safe to resend to another host
+// on failure, e.g. it isn't an INSERT or other statement with side effects
+func isIdempotentQuery(query []byte) bool {
+	q := bytes.ToUpper(bytes.TrimSpace(query))
+	for _, prefix := range idempotentPrefixes {
+		if bytes.HasPrefix(q, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryFromRequest extracts the query text chproxy is about to execute,
+// either from the `query` URL param (GET) or from the request body (POST)
+func queryFromRequest(req *http.Request, body []byte) []byte {
+	if q := req.URL.Query().Get("query"); len(q) > 0 {
+		return []byte(q)
+	}
+	return body
+}
+
+// isRetryableResponse reports whether resp warrants retrying the request
+// against another host, i.e. a ClickHouse-side 5xx response
+func isRetryableResponse(resp *http.Response) bool {
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// backoff returns the delay before retry attempt n (1-based), exponential
+// with full jitter, bounded by max
+func backoff(n int, initial, max time.Duration) time.Duration {
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	d := initial << uint(n-1)
+	if d <= 0 || d > max {
+		d = max
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// forwardWithRetry forwards req to s.host (already picked and accounted for
+// by newScope/scope.inc), retrying against other hosts in the cluster on
+// network errors and 5xx responses. Only idempotent queries (see
+// isIdempotentQuery) are retried, and retries stop once ctx is done.
+//
+// Every host a retry attempt runs against gets the same host.inc/dec and
+// recordLatency bookkeeping the originally-selected host gets from
+// scope.inc/scope.dec, so runningQueries and the EWMA load-balancing
+// signal stay accurate across retries, and a drain in progress on an
+// abandoned host sees its query count drop immediately. s.host and
+// s.start track whichever host is currently being attempted, so the
+// caller's eventual scope.dec() always accounts for the last attempt.
+func forwardWithRetry(ctx context.Context, s *scope, req *http.Request, body []byte) (*http.Response, error) {
+	c := s.cluster
+	retryable := isIdempotentQuery(queryFromRequest(req, body))
+	maxRetries := c.maxRetries
+
+	excluded := make(map[*host]bool)
+	var lastErr error
+
+	for attempt := 0; ; attempt++ {
+		h := s.host
+
+		resp, err := doForward(c, h, req, body)
+		if err == nil && !isRetryableResponse(resp) {
+			return resp, nil
+		}
+
+		lastErr = err
+		if !retryable || attempt >= maxRetries {
+			return resp, err
+		}
+
+		if resp != nil {
+			// drain so the connection can be reused/returned to the
+			// pool instead of leaking it on every retried 5xx
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		log.Debugf("retrying request to %q on another host after error: %v", h.addr.Host, err)
+		c.recordFailure(h)
+		excluded[h] = true
+
+		select {
+		case <-time.After(backoff(attempt+1, c.initialBackoff, c.maxBackoff)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		next := c.getHostExcluding(excluded)
+		if next == nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, context.Canceled
+		}
+
+		// h is being abandoned and won't be touched again by the
+		// caller's scope.dec(), which only ever sees s.host - account
+		// for it here before moving on
+		h.recordLatency(time.Since(s.start), c.ewmaDecay)
+		h.dec()
+
+		next.inc()
+		s.host = next
+		s.start = time.Now()
+	}
+}
+
+// doForward sends req's method, headers and body to h over c's per-cluster
+// transport, returning the raw upstream response
+func doForward(c *cluster, h *host, req *http.Request, body []byte) (*http.Response, error) {
+	addr := *h.addr
+	addr.RawQuery = req.URL.RawQuery
+
+	freq, err := http.NewRequest(req.Method, addr.String(), ioutil.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	freq = freq.WithContext(req.Context())
+	freq.Header = req.Header
+
+	return c.httpClient.Do(freq)
+}
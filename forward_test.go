@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsIdempotentQuery(t *testing.T) {
+	testCases := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT 1", true},
+		{"  select * from foo", true},
+		{"SHOW TABLES", true},
+		{"DESCRIBE foo", true},
+		{"EXISTS TABLE foo", true},
+		{"INSERT INTO foo VALUES (1)", false},
+		{"ALTER TABLE foo DELETE WHERE 1", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if got := isIdempotentQuery([]byte(tc.query)); got != tc.want {
+			t.Errorf("isIdempotentQuery(%q) = %v; want %v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestQueryFromRequest(t *testing.T) {
+	req := &http.Request{URL: &url.URL{RawQuery: "query=" + url.QueryEscape("SELECT 1")}}
+	if got := string(queryFromRequest(req, []byte("ignored"))); got != "SELECT 1" {
+		t.Errorf("queryFromRequest with query param = %q; want %q", got, "SELECT 1")
+	}
+
+	req = &http.Request{URL: &url.URL{}}
+	if got := string(queryFromRequest(req, []byte("INSERT INTO foo VALUES (1)"))); got != "INSERT INTO foo VALUES (1)" {
+		t.Errorf("queryFromRequest falling back to body = %q", got)
+	}
+}
+
+func TestIsRetryableResponse(t *testing.T) {
+	testCases := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusBadRequest, false},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+	}
+
+	for _, tc := range testCases {
+		resp := &http.Response{StatusCode: tc.status}
+		if got := isRetryableResponse(resp); got != tc.want {
+			t.Errorf("isRetryableResponse(%d) = %v; want %v", tc.status, got, tc.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	initial := 100 * time.Millisecond
+	max := time.Second
+
+	for n := 1; n <= 10; n++ {
+		d := backoff(n, initial, max)
+		if d < 0 {
+			t.Fatalf("backoff(%d) = %s; want >= 0", n, d)
+		}
+		if d > max {
+			t.Fatalf("backoff(%d) = %s; want <= max %s", n, d, max)
+		}
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	d := backoff(1, 0, 0)
+	if d < 0 || d > defaultMaxBackoff {
+		t.Fatalf("backoff(1, 0, 0) = %s; want within [0, %s]", d, defaultMaxBackoff)
+	}
+}
+
+func TestForwardWithRetryAccountsForEachAttemptedHost(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ok.Close()
+
+	hFail := newHost(mustParseURL(t, failing.URL))
+	hOK := newHost(mustParseURL(t, ok.URL))
+
+	c := &cluster{
+		name:       "test",
+		hosts:      []*host{hFail, hOK},
+		maxRetries: 1,
+		httpClient: &http.Client{},
+	}
+
+	s := &scope{host: hFail, cluster: c, class: classInteractive}
+	hFail.inc()
+	s.start = time.Now()
+
+	req := &http.Request{Method: "GET", URL: &url.URL{RawQuery: "query=" + url.QueryEscape("SELECT 1")}}
+
+	resp, err := forwardWithRetry(context.Background(), s, req, []byte("SELECT 1"))
+	if err != nil {
+		t.Fatalf("forwardWithRetry() error = %v", err)
+	}
+	resp.Body.Close()
+
+	if got := hFail.runningQueries(); got != 0 {
+		t.Fatalf("abandoned host runningQueries = %d; want 0", got)
+	}
+	if s.host != hOK {
+		t.Fatalf("s.host after retry = %v; want the host that served the final response %v", s.host.addr, hOK.addr)
+	}
+	if got := hOK.runningQueries(); got != 1 {
+		t.Fatalf("final host runningQueries = %d after the retry succeeded on it; want 1, left outstanding for scope.dec to release", got)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hagen1778/chproxy/log"
+)
+
+const (
+	defaultHeartbeatInterval = 5 * time.Second
+	defaultHeartbeatTimeout  = time.Second
+
+	// number of consecutive failures/successes required to flip the
+	// healthy flag, so a single flaky probe doesn't eject a host
+	failuresToEject   = 3
+	successesToRevive = 1
+)
+
+// startHeartbeat periodically probes every host in the cluster with a
+// cheap query and ejects hosts that stop responding. It runs until done
+// is closed.
+func (c *cluster) startHeartbeat(done <-chan struct{}) {
+	interval := c.heartbeatInterval
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, h := range c.hosts {
+					go c.heartbeat(h)
+				}
+			}
+		}
+	}()
+}
+
+func (c *cluster) heartbeat(h *host) {
+	timeout := c.heartbeatTimeout
+	if timeout <= 0 {
+		timeout = defaultHeartbeatTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := pingHost(ctx, c, h); err != nil {
+		log.Debugf("heartbeat to %q failed: %s", h.addr.Host, err)
+		c.recordFailure(h)
+		return
+	}
+
+	c.recordSuccess(h)
+}
+
+// pingHost probes h with a cheap query over c's pooled per-cluster
+// transport (see transport.go), rather than opening a second, unpooled
+// http.Client just for heartbeats. ctx bounds how long the probe is
+// allowed to take.
+func pingHost(ctx context.Context, c *cluster, h *host) error {
+	addr := *h.addr
+	q := addr.Query()
+	q.Set("query", "SELECT 1")
+	addr.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", addr.String(), nil)
+	if err != nil {
+		return fmt.Errorf("error while creating heartbeat request to %s: %s", addr.Host, err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while performing heartbeat request to %s: %s", addr.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code returned from heartbeat at %s: %d", addr.Host, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *cluster) recordFailure(h *host) {
+	fails := h.consecFails.inc()
+	h.consecSuccesses.reset()
+
+	if fails >= failuresToEject && h.setHealthy(false) {
+		log.Errorf("cluster %q: ejecting unhealthy host %q", c.name, h.addr.Host)
+		hostHealth.WithLabelValues(c.name, h.addr.Host).Set(0)
+	}
+}
+
+func (c *cluster) recordSuccess(h *host) {
+	successes := h.consecSuccesses.inc()
+	h.consecFails.reset()
+
+	// a draining host still answers heartbeats fine - it's not actually
+	// down - so a successful probe must not revive it and undo the drain
+	if h.isDraining() {
+		return
+	}
+
+	if successes >= successesToRevive && h.setHealthy(true) {
+		log.Infof("cluster %q: host %q is healthy again", c.name, h.addr.Host)
+		hostHealth.WithLabelValues(c.name, h.addr.Host).Set(1)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %s", raw, err)
+	}
+	return u
+}
+
+func TestRecordFailureEjectsAfterThreshold(t *testing.T) {
+	c := &cluster{name: "test"}
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+
+	for i := 1; i < failuresToEject; i++ {
+		c.recordFailure(h)
+		if !h.isHealthy() {
+			t.Fatalf("host was ejected after only %d consecutive failures; want %d", i, failuresToEject)
+		}
+	}
+
+	c.recordFailure(h)
+	if h.isHealthy() {
+		t.Fatalf("expected host to be ejected after %d consecutive failures", failuresToEject)
+	}
+}
+
+func TestRecordSuccessRevivesHost(t *testing.T) {
+	c := &cluster{name: "test"}
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+	h.setHealthy(false)
+
+	c.recordSuccess(h)
+	if !h.isHealthy() {
+		t.Fatalf("expected host to be healthy again after a successful heartbeat")
+	}
+}
+
+func TestRecordFailureResetsSuccessStreak(t *testing.T) {
+	c := &cluster{name: "test"}
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+
+	c.recordSuccess(h)
+	c.recordFailure(h)
+
+	if h.consecSuccesses.value != 0 {
+		t.Fatalf("consecSuccesses = %d after a failure; want 0", h.consecSuccesses.value)
+	}
+}
+
+func TestRecordSuccessResetsFailureStreak(t *testing.T) {
+	c := &cluster{name: "test"}
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+
+	c.recordFailure(h)
+	c.recordSuccess(h)
+
+	if h.consecFails.value != 0 {
+		t.Fatalf("consecFails = %d after a success; want 0", h.consecFails.value)
+	}
+}
+
+func TestPingHostUsesClusterHTTPClient(t *testing.T) {
+	var gotUserAgent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserAgent = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	const userAgent = "chproxy-heartbeat-test"
+	c := &cluster{
+		name: "test",
+		httpClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				req.Header.Set("User-Agent", userAgent)
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		},
+	}
+	h := newHost(mustParseURL(t, srv.URL))
+
+	if err := pingHost(context.Background(), c, h); err != nil {
+		t.Fatalf("pingHost() = %v; want nil", err)
+	}
+	if gotUserAgent != userAgent {
+		t.Fatalf("heartbeat request went out through a client other than c.httpClient: got User-Agent %q, want %q", gotUserAgent, userAgent)
+	}
+}
+
+func TestPingHostPropagatesContextTimeout(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	c := &cluster{name: "test", httpClient: &http.Client{}}
+	h := newHost(mustParseURL(t, srv.URL))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := pingHost(ctx, c, h); err == nil {
+		t.Fatalf("expected pingHost() to fail once ctx times out")
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRecordSuccessDoesNotReviveADrainingHost(t *testing.T) {
+	c := &cluster{name: "test"}
+	h := newHost(mustParseURL(t, "http://127.0.0.1:8123/"))
+	h.setDraining(true)
+	h.setHealthy(false)
+
+	c.recordSuccess(h)
+	if h.isHealthy() {
+		t.Fatalf("expected a successful heartbeat to not revive a draining host")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Limiter is a dynamically adjustable cap on top of a queryCounter. Unlike
+// the static maxConcurrentQueries checked in scope.inc, its max can be
+// lowered at runtime (e.g. to drain a host, see drain.go) so usage that was
+// previously allowed starts getting rejected until it falls back under the
+// new max.
+type Limiter struct {
+	// max is negative while the limiter is disabled, i.e. no cap is applied
+	max int32
+}
+
+func newLimiter() *Limiter {
+	return &Limiter{max: -1}
+}
+
+// SetMax adjusts the cap. Pass a negative value to disable the limiter.
+func (l *Limiter) SetMax(max int32) {
+	atomic.StoreInt32(&l.max, max)
+}
+
+func (l *Limiter) currentMax() int32 {
+	return atomic.LoadInt32(&l.max)
+}
+
+// allow reports whether usage is still within the currently configured max
+func (l *Limiter) allow(usage uint32) bool {
+	max := l.currentMax()
+	return max < 0 || int32(usage) <= max
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestLimiterDisabledByDefault(t *testing.T) {
+	l := newLimiter()
+	if !l.allow(0) || !l.allow(1000000) {
+		t.Fatalf("a fresh Limiter should allow any usage until SetMax is called")
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	testCases := []struct {
+		max   int32
+		usage uint32
+		want  bool
+	}{
+		{0, 0, true},
+		{0, 1, false},
+		{5, 5, true},
+		{5, 6, false},
+		{-1, 1000000, true},
+	}
+
+	for _, tc := range testCases {
+		l := newLimiter()
+		l.SetMax(tc.max)
+		if got := l.allow(tc.usage); got != tc.want {
+			t.Errorf("Limiter{max: %d}.allow(%d) = %v; want %v", tc.max, tc.usage, got, tc.want)
+		}
+	}
+}
+
+func TestLimiterSetMaxIsDynamic(t *testing.T) {
+	l := newLimiter()
+	l.SetMax(10)
+	if !l.allow(10) {
+		t.Fatalf("expected usage 10 to be allowed under max 10")
+	}
+
+	l.SetMax(5)
+	if l.allow(10) {
+		t.Fatalf("expected usage 10 to be rejected after lowering max to 5")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var hostHealth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chproxy_host_health",
+		Help: "Status of the host as seen by the active health checker: 1 - healthy, 0 - unhealthy",
+	},
+	[]string{"cluster", "host"},
+)
+
+var transportPoolSize = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chproxy_transport_pool_size",
+		Help: "Configured MaxIdleConnsPerHost for a cluster's upstream transport",
+	},
+	[]string{"cluster"},
+)
+
+var transportInUseConns = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chproxy_transport_in_use_connections",
+		Help: "Number of requests currently in flight on a cluster's upstream transport",
+	},
+	[]string{"cluster"},
+)
+
+var transportConnsOpened = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chproxy_transport_conns_opened_total",
+		Help: "Total number of new upstream connections dialed for a cluster, i.e. the pool couldn't reuse an idle one",
+	},
+	[]string{"cluster"},
+)
+
+func init() {
+	prometheus.MustRegister(
+		hostHealth,
+		transportPoolSize,
+		transportInUseConns,
+		transportConnsOpened,
+	)
+}
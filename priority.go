@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// priorityClass classifies an incoming request so it can be limited and
+// queued independently of other classes, see scope.inc.
+type priorityClass int
+
+const (
+	classInteractive priorityClass = iota
+	classBatch
+)
+
+func (p priorityClass) String() string {
+	if p == classInteractive {
+		return "interactive"
+	}
+	return "batch"
+}
+
+// priorityHeader lets a client opt a request into a class explicitly,
+// overriding the query-text heuristic below
+const priorityHeader = "X-ChProxy-Priority"
+
+// shortInteractiveQuery bounds how long a SELECT ... LIMIT query can be and
+// still be heuristically classified as interactive
+const shortInteractiveQuery = 256
+
+// classify decides whether a request belongs to the interactive or batch
+// class, checking, in order: the configured list of always-interactive
+// users, the X-ChProxy-Priority header, and finally a query-text heuristic.
+func classify(req *http.Request, query []byte, userName string, interactiveUsers map[string]bool) priorityClass {
+	if interactiveUsers[userName] {
+		return classInteractive
+	}
+
+	switch req.Header.Get(priorityHeader) {
+	case "interactive":
+		return classInteractive
+	case "batch":
+		return classBatch
+	}
+
+	if looksInteractive(query) {
+		return classInteractive
+	}
+
+	return classBatch
+}
+
+// looksInteractive is a cheap heuristic for "the user is waiting on this":
+// a short, bounded SELECT rather than a long-running aggregation
+func looksInteractive(query []byte) bool {
+	q := bytes.ToUpper(bytes.TrimSpace(query))
+	if len(q) == 0 || len(q) > shortInteractiveQuery {
+		return false
+	}
+	return bytes.HasPrefix(q, []byte("SELECT")) && bytes.Contains(q, []byte("LIMIT"))
+}
+
+// classCounters tracks running queries per priorityClass, on top of the
+// aggregate queryCounter already embedded in user/clusterUser.
+type classCounters struct {
+	interactive queryCounter
+	batch       queryCounter
+}
+
+func (cc *classCounters) inc(class priorityClass) uint32 {
+	if class == classBatch {
+		return cc.batch.inc()
+	}
+	return cc.interactive.inc()
+}
+
+func (cc *classCounters) dec(class priorityClass) {
+	if class == classBatch {
+		cc.batch.dec()
+		return
+	}
+	cc.interactive.dec()
+}
+
+func (cc *classCounters) running(class priorityClass) uint32 {
+	if class == classBatch {
+		return cc.batch.runningQueries()
+	}
+	return cc.interactive.runningQueries()
+}
+
+// batchQueuePollInterval is a fallback poll period: a slot can also free up
+// via a request that never went through a batchQueue at all (e.g. an
+// interactive query finishing), which wouldn't otherwise wake the waiter at
+// the front of the line.
+const batchQueuePollInterval = 50 * time.Millisecond
+
+// batchQueue bounds how many batch requests may wait for a free slot once
+// max_concurrent_batch is hit, and for how long. Interactive requests never
+// go through a batchQueue.
+//
+// Waiters are served in strict arrival order: only the waiter at the front
+// of waiters is allowed to claim a freed slot, so a later arrival can never
+// jump ahead of one that's been waiting longer.
+type batchQueue struct {
+	mu      sync.Mutex
+	waiters []chan struct{}
+
+	size    int32
+	maxWait time.Duration
+}
+
+func newBatchQueue(size int32, maxWait time.Duration) *batchQueue {
+	return &batchQueue{size: size, maxWait: maxWait}
+}
+
+// join enqueues a new waiter at the back of the line, or reports that the
+// queue is full.
+func (q *batchQueue) join() (chan struct{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if int32(len(q.waiters)) >= q.size {
+		return nil, false
+	}
+
+	ch := make(chan struct{}, 1)
+	q.waiters = append(q.waiters, ch)
+	return ch, true
+}
+
+// isFront reports whether ch is at the front of the line, i.e. the only
+// waiter currently allowed to claim a freed slot.
+func (q *batchQueue) isFront(ch chan struct{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiters) > 0 && q.waiters[0] == ch
+}
+
+// leave removes ch from the line and wakes whichever waiter is now at the
+// front, so it doesn't have to wait for the next poll tick to notice.
+func (q *batchQueue) leave(ch chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, w := range q.waiters {
+		if w == ch {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(q.waiters) > 0 {
+		select {
+		case q.waiters[0] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait blocks until ch reaches the front of the line and running(classBatch)
+// drops to/below max, the queue's maxWait elapses, or ctx is done, whichever
+// happens first.
+func (q *batchQueue) wait(ctx context.Context, cc *classCounters, max uint32) error {
+	ch, ok := q.join()
+	if !ok {
+		return fmt.Errorf("batch queue is full")
+	}
+	defer q.leave(ch)
+
+	maxWait := q.maxWait
+	if maxWait <= 0 {
+		maxWait = time.Minute
+	}
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	for {
+		if q.isFront(ch) && cc.running(classBatch) <= max {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("timed out after %s waiting for a free batch slot", maxWait)
+		case <-ch:
+		case <-time.After(batchQueuePollInterval):
+		}
+	}
+}
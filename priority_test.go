@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLooksInteractive(t *testing.T) {
+	testCases := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT 1 LIMIT 10", true},
+		{"select name from users limit 5", true},
+		{"SELECT count(*) FROM huge_table GROUP BY key", false},
+		{"SELECT * FROM t", false},
+		{"INSERT INTO t VALUES (1) LIMIT 1", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if got := looksInteractive([]byte(tc.query)); got != tc.want {
+			t.Errorf("looksInteractive(%q) = %v; want %v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestLooksInteractiveRejectsLongQueries(t *testing.T) {
+	long := make([]byte, shortInteractiveQuery+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	query := append([]byte("SELECT "), long...)
+	query = append(query, []byte(" LIMIT 1")...)
+
+	if looksInteractive(query) {
+		t.Fatalf("expected a query longer than %d bytes to not be classified as interactive", shortInteractiveQuery)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	interactiveUsers := map[string]bool{"dashboard": true}
+
+	testCases := []struct {
+		name      string
+		userName  string
+		header    string
+		query     string
+		wantClass priorityClass
+	}{
+		{"configured interactive user", "dashboard", "", "INSERT INTO t VALUES (1)", classInteractive},
+		{"header overrides heuristic", "reports", "interactive", "INSERT INTO t VALUES (1)", classInteractive},
+		{"header forces batch", "reports", "batch", "SELECT 1 LIMIT 1", classBatch},
+		{"heuristic picks interactive", "reports", "", "SELECT 1 LIMIT 1", classInteractive},
+		{"heuristic falls back to batch", "reports", "", "SELECT count(*) FROM big GROUP BY x", classBatch},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{}}
+			if tc.header != "" {
+				req.Header.Set(priorityHeader, tc.header)
+			}
+
+			got := classify(req, []byte(tc.query), tc.userName, interactiveUsers)
+			if got != tc.wantClass {
+				t.Errorf("classify() = %q; want %q", got, tc.wantClass)
+			}
+		})
+	}
+}
+
+func TestBatchQueueWaitReturnsImmediatelyWhenUnderCap(t *testing.T) {
+	q := newBatchQueue(1, time.Second)
+	var cc classCounters
+	cc.inc(classBatch)
+
+	if err := q.wait(context.Background(), &cc, 5); err != nil {
+		t.Fatalf("wait() = %v; want nil when usage is under max", err)
+	}
+}
+
+func TestBatchQueueWaitTimesOut(t *testing.T) {
+	q := newBatchQueue(1, 20*time.Millisecond)
+	var cc classCounters
+	cc.inc(classBatch)
+	cc.inc(classBatch)
+
+	err := q.wait(context.Background(), &cc, 1)
+	if err == nil {
+		t.Fatalf("expected wait() to time out while usage stays above max")
+	}
+}
+
+func TestBatchQueueWaitRespectsContextCancellation(t *testing.T) {
+	q := newBatchQueue(1, time.Minute)
+	var cc classCounters
+	cc.inc(classBatch)
+	cc.inc(classBatch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := q.wait(ctx, &cc, 1)
+	if err != context.Canceled {
+		t.Fatalf("wait() = %v; want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Minute {
+		t.Fatalf("wait() took %s; expected to return promptly on ctx cancellation", elapsed)
+	}
+}
+
+func TestBatchQueueRejectsWhenFull(t *testing.T) {
+	q := newBatchQueue(0, time.Second)
+	var cc classCounters
+
+	if err := q.wait(context.Background(), &cc, 0); err == nil {
+		t.Fatalf("expected wait() to reject immediately when the queue has no room")
+	}
+}
+
+func TestBatchQueueWaitIsFIFO(t *testing.T) {
+	q := newBatchQueue(3, time.Second)
+	var cc classCounters
+	for i := 0; i < 5; i++ {
+		cc.inc(classBatch)
+	}
+	const max = 2
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+
+	// start the waiters one at a time; the sleep between starts gives
+	// each one time to join the line before the next one starts
+	for i := 0; i < 3; i++ {
+		i := i
+		joined := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			close(joined)
+			if err := q.wait(context.Background(), &cc, max); err != nil {
+				t.Errorf("wait() = %v; want nil", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}()
+		<-joined
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// usage stays above max until every waiter has joined the line, so
+	// none of them can race ahead before arrival order is fixed
+	for cc.running(classBatch) > max {
+		cc.dec(classBatch)
+	}
+
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("waiters were released in order %v; want strict arrival order 0,1,2", order)
+		}
+	}
+}
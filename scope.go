@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,11 +16,12 @@ import (
 )
 
 func (s *scope) String() string {
-	return fmt.Sprintf("[ Id: %d; User %q(%d) proxying as %q(%d) to %q(%d) ]",
+	return fmt.Sprintf("[ Id: %d; User %q(%d) proxying as %q(%d) to %q(%d); class %q ]",
 		s.id,
 		s.user.name, s.user.runningQueries(),
 		s.clusterUser.name, s.clusterUser.runningQueries(),
-		s.host.addr.Host, s.host.runningQueries())
+		s.host.addr.Host, s.host.runningQueries(),
+		s.class)
 }
 
 type scope struct {
@@ -27,24 +30,32 @@ type scope struct {
 	cluster     *cluster
 	user        *user
 	clusterUser *clusterUser
+	class       priorityClass
+
+	// start is set once inc() has admitted the request, so dec() can
+	// feed the host's EWMA latency tracker with how long it ran for
+	start time.Time
 }
 
 var scopeId = uint32(time.Now().UnixNano())
 
-func newScope(u *user, cu *clusterUser, c *cluster) *scope {
+func newScope(u *user, cu *clusterUser, c *cluster, class priorityClass) *scope {
 	return &scope{
 		id:          atomic.AddUint32(&scopeId, 1),
 		host:        c.getHost(),
 		cluster:     c,
 		user:        u,
 		clusterUser: cu,
+		class:       class,
 	}
 }
 
-func (s *scope) inc() error {
+func (s *scope) inc(ctx context.Context) error {
 	uq := s.user.inc()
 	cq := s.clusterUser.inc()
-	s.host.inc()
+	hq := s.host.inc()
+	ucq := s.user.classes.inc(s.class)
+	ccq := s.clusterUser.classes.inc(s.class)
 
 	var err error
 	if s.user.maxConcurrentQueries > 0 && uq > s.user.maxConcurrentQueries {
@@ -55,18 +66,67 @@ func (s *scope) inc() error {
 		err = fmt.Errorf("limits for cluster user %q are exceeded: maxConcurrentQueries limit: %d", s.clusterUser.name, s.clusterUser.maxConcurrentQueries)
 	}
 
+	if !s.host.limiter.allow(hq) {
+		err = &errResourceExhausted{fmt.Errorf("host %q is draining: too many concurrent queries", s.host.addr.Host)}
+	}
+
+	if err == nil {
+		err = s.checkClassLimit(ctx, ucq, ccq)
+	}
+
 	if err != nil {
 		s.dec()
 		return err
 	}
 
+	s.start = time.Now()
+	log.Debugf("%s", s)
 	return nil
 }
 
+// checkClassLimit enforces the per-class caps on both the user and the
+// clusterUser, mirroring how maxConcurrentQueries is checked independently
+// at both tiers above. A user over its cap is rejected immediately;
+// interactive requests over the clusterUser's cap are also rejected
+// immediately, while batch requests instead wait in the clusterUser's
+// batchQueue for a free slot, if one is configured.
+func (s *scope) checkClassLimit(ctx context.Context, userUsage, clusterUserUsage uint32) error {
+	u := s.user
+	if max := classMax(u.maxConcurrentInteractive, u.maxConcurrentBatch, s.class); max > 0 && userUsage > max {
+		return fmt.Errorf("limits for user %q are exceeded: max_concurrent_%s limit: %d", u.name, s.class, max)
+	}
+
+	cu := s.clusterUser
+	max := classMax(cu.maxConcurrentInteractive, cu.maxConcurrentBatch, s.class)
+	if max == 0 || clusterUserUsage <= max {
+		return nil
+	}
+
+	if s.class == classInteractive || cu.batchQueue == nil {
+		return fmt.Errorf("limits for cluster user %q are exceeded: max_concurrent_%s limit: %d", cu.name, s.class, max)
+	}
+
+	return cu.batchQueue.wait(ctx, &cu.classes, max)
+}
+
+// classMax picks the configured cap matching class
+func classMax(interactiveMax, batchMax uint32, class priorityClass) uint32 {
+	if class == classInteractive {
+		return interactiveMax
+	}
+	return batchMax
+}
+
 func (s *scope) dec() {
 	s.host.dec()
 	s.user.dec()
 	s.clusterUser.dec()
+	s.user.classes.dec(s.class)
+	s.clusterUser.classes.dec(s.class)
+
+	if !s.start.IsZero() {
+		s.host.recordLatency(time.Since(s.start), s.cluster.ewmaDecay)
+	}
 }
 
 type user struct {
@@ -78,6 +138,10 @@ type user struct {
 	maxExecutionTime     time.Duration
 	maxConcurrentQueries uint32
 
+	maxConcurrentInteractive uint32
+	maxConcurrentBatch       uint32
+	classes                  classCounters
+
 	queryCounter
 }
 
@@ -86,33 +150,156 @@ type clusterUser struct {
 	maxExecutionTime     time.Duration
 	maxConcurrentQueries uint32
 
+	maxConcurrentInteractive uint32
+	maxConcurrentBatch       uint32
+	batchQueue               *batchQueue
+	classes                  classCounters
+
 	queryCounter
 }
 
 type host struct {
 	addr *url.URL
 
+	// healthy is 1 until the host is ejected, and 0 after that: ejection
+	// follows failuresToEject consecutive failed heartbeats or retried
+	// requests (see recordFailure), or a drainHost. getHost skips
+	// unhealthy hosts unless none is healthy.
+	healthy int32
+
+	// draining is 1 while an operator-initiated drainHost is evacuating
+	// this host. A draining host keeps answering heartbeats fine (it's
+	// not actually down), so the heartbeat checker must not use a
+	// successful probe to flip healthy back to 1 and undo the drain.
+	draining int32
+
+	consecFails     counter
+	consecSuccesses counter
+
+	// limiter caps in-flight queries on this host independently of the
+	// per-user/clusterUser limits, so it can be drained at runtime
+	// without waiting for a config reload
+	limiter *Limiter
+
+	// latencyMu guards ewmaLatency/lastLatencyUpdate, used by the
+	// p2c_ewma load balancing policy, see balancer.go
+	latencyMu         sync.Mutex
+	ewmaLatency       time.Duration
+	lastLatencyUpdate time.Time
+
 	queryCounter
 }
 
+func newHost(addr *url.URL) *host {
+	return &host{
+		addr:    addr,
+		healthy: 1,
+		limiter: newLimiter(),
+	}
+}
+
+// recordLatency folds d into the host's exponentially-weighted moving
+// average response time, decaying older samples over decay.
+func (h *host) recordLatency(d, decay time.Duration) {
+	h.latencyMu.Lock()
+	defer h.latencyMu.Unlock()
+
+	now := time.Now()
+	if h.ewmaLatency == 0 {
+		h.ewmaLatency = d
+		h.lastLatencyUpdate = now
+		return
+	}
+
+	if decay <= 0 {
+		decay = defaultEWMADecay
+	}
+	w := float64(now.Sub(h.lastLatencyUpdate)) / float64(decay)
+	if w > 1 {
+		w = 1
+	}
+
+	h.ewmaLatency = time.Duration(float64(h.ewmaLatency)*(1-w) + float64(d)*w)
+	h.lastLatencyUpdate = now
+}
+
+func (h *host) latency() time.Duration {
+	h.latencyMu.Lock()
+	defer h.latencyMu.Unlock()
+	return h.ewmaLatency
+}
+
+func (h *host) isHealthy() bool {
+	return atomic.LoadInt32(&h.healthy) == 1
+}
+
+// setHealthy sets the host's healthy flag and reports whether it actually
+// changed state.
+func (h *host) setHealthy(healthy bool) bool {
+	if healthy {
+		return atomic.CompareAndSwapInt32(&h.healthy, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(&h.healthy, 1, 0)
+}
+
+// isDraining reports whether h is being evacuated by drainHost, see
+// drain.go.
+func (h *host) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// setDraining sets the host's draining flag.
+func (h *host) setDraining(draining bool) {
+	v := int32(0)
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&h.draining, v)
+}
+
 type cluster struct {
+	name                  string
 	nextIdx               uint32
 	hosts                 []*host
 	users                 map[string]*clusterUser
 	killQueryUserName     string
 	killQueryUserPassword string
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	loadBalancing loadBalancingPolicy
+	ewmaDecay     time.Duration
+
+	// httpClient is this cluster's own pooled client, used instead of a
+	// process-wide one for KILL QUERY requests, heartbeats and the main
+	// forwarding path (see forward.go). All three share its connection
+	// pool.
+	httpClient *http.Client
 }
 
-func newCluster(h []*host, cu map[string]*clusterUser) *cluster {
-	return &cluster{
-		hosts:   h,
-		users:   cu,
-		nextIdx: uint32(time.Now().UnixNano()),
+func newCluster(name string, h []*host, cu map[string]*clusterUser, transportCfg TransportConfig) *cluster {
+	transport := newTransport(name, transportCfg)
+
+	// hosts are created healthy (see newHost) and only flip to unhealthy
+	// after failuresToEject consecutive failures or a drain, so seed the
+	// gauge accordingly
+	// instead of leaving it at its zero-value default until the first tick
+	for _, host := range h {
+		hostHealth.WithLabelValues(name, host.addr.Host).Set(1)
 	}
-}
 
-var client = &http.Client{
-	Timeout: time.Second * 60,
+	return &cluster{
+		name:       name,
+		hosts:      h,
+		users:      cu,
+		nextIdx:    uint32(time.Now().UnixNano()),
+		httpClient: newHTTPClient(name, transport),
+	}
 }
 
 // We don't use query_id because of distributed processing, the query ID is not passed to remote servers
@@ -124,60 +311,69 @@ func (c *cluster) killQueries(ua string, elapsed float64) error {
 	query := fmt.Sprintf("KILL QUERY WHERE http_user_agent = '%s' AND elapsed >= %d", ua, int(elapsed))
 	log.Debugf("ExecutionTime exceeded. Going to call query %q", query)
 
-	for _, host := range c.hosts {
-		r := strings.NewReader(query)
-		addr := host.addr.String()
-
-		req, err := http.NewRequest("POST", addr, r)
-		if err != nil {
-			return fmt.Errorf("error while creating kill query request to %s: %s", addr, err)
+	for _, h := range c.hosts {
+		if err := c.execKillQuery(h, query); err != nil {
+			return err
 		}
-		setAuth(req, c.killQueryUserName, c.killQueryUserPassword)
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("error while executing clickhouse query %q at %q: %s", query, addr, err)
-		}
+	return nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			responseBody, _ := ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-			return fmt.Errorf("unexpected status code returned from query %q at %q: %d. Response body: %q",
-				query, addr, resp.StatusCode, responseBody)
-		}
-		resp.Body.Close()
+// killAllQueriesOnHost force-kills every query currently running on h,
+// regardless of user agent or elapsed time. Used to evacuate a host being
+// drained, see drain.go.
+func (c *cluster) killAllQueriesOnHost(h *host) error {
+	if len(c.killQueryUserName) == 0 {
+		return fmt.Errorf("cannot drain host %q: no kill_query user configured for cluster %q", h.addr.Host, c.name)
 	}
 
-	return nil
+	return c.execKillQuery(h, "KILL QUERY WHERE 1")
 }
 
-// get least loaded + round-robin host from cluster
-func (c *cluster) getHost() *host {
-	idx := atomic.AddUint32(&c.nextIdx, 1)
+func (c *cluster) execKillQuery(h *host, query string) error {
+	r := strings.NewReader(query)
+	addr := h.addr.String()
 
-	l := uint32(len(c.hosts))
-	idx = idx % l
-	idle := c.hosts[idx]
-	idleN := idle.runningQueries()
+	req, err := http.NewRequest("POST", addr, r)
+	if err != nil {
+		return fmt.Errorf("error while creating kill query request to %s: %s", addr, err)
+	}
+	setAuth(req, c.killQueryUserName, c.killQueryUserPassword)
 
-	if idleN == 0 {
-		return idle
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while executing clickhouse query %q at %q: %s", query, addr, err)
 	}
+	defer resp.Body.Close()
 
-	// round hosts checking
-	// until the least loaded is found
-	for i := (idx + 1) % l; i != idx; i = (i + 1) % l {
-		h := c.hosts[i]
-		n := h.runningQueries()
-		if n == 0 {
-			return h
-		}
-		if n < idleN {
-			idle, idleN = h, n
-		}
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code returned from query %q at %q: %d. Response body: %q",
+			query, addr, resp.StatusCode, responseBody)
 	}
 
-	return idle
+	return nil
+}
+
+// getHost picks a host to forward a query to, according to the cluster's
+// loadBalancing policy. See balancer.go.
+//
+// Unhealthy hosts (as tracked by the heartbeat checker, see health.go) are
+// skipped entirely unless every host in the cluster is unhealthy, in which
+// case we fall back to balancing across all of them rather than failing
+// every request. Draining hosts are never picked, not even in that
+// fallback (see eligibleHosts); if every host is draining, getHost
+// returns nil.
+func (c *cluster) getHost() *host {
+	return c.selectHost(c.eligibleHosts(nil))
+}
+
+// getHostExcluding behaves like getHost but never returns a host present in
+// excluded. It's used by the retry path (see forward.go) to avoid picking
+// the same host that just failed a request.
+func (c *cluster) getHostExcluding(excluded map[*host]bool) *host {
+	return c.selectHost(c.eligibleHosts(excluded))
 }
 
 type queryCounter struct {
@@ -195,3 +391,17 @@ func (qc *queryCounter) inc() uint32 {
 func (qc *queryCounter) dec() {
 	atomic.AddUint32(&qc.value, ^uint32(0))
 }
+
+// counter is a small atomic counter used to track consecutive events, e.g.
+// heartbeat failures/successes in a row
+type counter struct {
+	value uint32
+}
+
+func (c *counter) inc() uint32 {
+	return atomic.AddUint32(&c.value, 1)
+}
+
+func (c *counter) reset() {
+	atomic.StoreUint32(&c.value, 0)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultDialTimeout         = 10 * time.Second
+	defaultRequestTimeout      = 60 * time.Second
+)
+
+// TransportConfig configures the per-cluster upstream HTTP transport.
+// Mirrors config.Cluster.Transport.
+type TransportConfig struct {
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	DialTimeout           time.Duration
+	ForceAttemptHTTP2     bool
+}
+
+// newTransport builds the http.Transport a cluster forwards queries and
+// KILL QUERY requests through: a keep-alive connection pool per upstream
+// host, with optional HTTP/2. The pool keeps at most MaxIdleConnsPerHost
+// idle connections per host; the number of connections in use at once is
+// not capped.
+func newTransport(clusterName string, cfg TransportConfig) *http.Transport {
+	maxIdle := cfg.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConnsPerHost
+	}
+	idleTimeout := cfg.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleConnTimeout
+	}
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	t := &http.Transport{
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       idleTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ForceAttemptHTTP2:     cfg.ForceAttemptHTTP2,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			transportConnsOpened.WithLabelValues(clusterName).Inc()
+			return conn, nil
+		},
+	}
+
+	transportPoolSize.WithLabelValues(clusterName).Set(float64(maxIdle))
+
+	return t
+}
+
+// countingRoundTripper tracks how many requests are currently in flight on
+// a cluster's transport, exposed as chproxy_transport_in_use_connections.
+type countingRoundTripper struct {
+	cluster string
+	next    http.RoundTripper
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	transportInUseConns.WithLabelValues(rt.cluster).Inc()
+	defer transportInUseConns.WithLabelValues(rt.cluster).Dec()
+
+	return rt.next.RoundTrip(req)
+}
+
+// newHTTPClient wraps transport with connection-usage instrumentation for
+// clusterName
+func newHTTPClient(clusterName string, transport *http.Transport) *http.Client {
+	return &http.Client{
+		Timeout:   defaultRequestTimeout,
+		Transport: &countingRoundTripper{cluster: clusterName, next: transport},
+	}
+}
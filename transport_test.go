@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewTransportDefaults(t *testing.T) {
+	tr := newTransport("test-defaults", TransportConfig{})
+
+	if tr.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Errorf("MaxIdleConnsPerHost = %d; want default %d", tr.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != defaultIdleConnTimeout {
+		t.Errorf("IdleConnTimeout = %s; want default %s", tr.IdleConnTimeout, defaultIdleConnTimeout)
+	}
+	if tr.DialContext == nil {
+		t.Errorf("expected a DialContext to be set")
+	}
+	if tr.ForceAttemptHTTP2 {
+		t.Errorf("ForceAttemptHTTP2 = true; want false by default")
+	}
+}
+
+func TestNewTransportAppliesOverrides(t *testing.T) {
+	cfg := TransportConfig{
+		MaxIdleConnsPerHost:   7,
+		IdleConnTimeout:       5 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	tr := newTransport("test-overrides", cfg)
+
+	if tr.MaxIdleConnsPerHost != 7 {
+		t.Errorf("MaxIdleConnsPerHost = %d; want 7", tr.MaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != 5*time.Second {
+		t.Errorf("IdleConnTimeout = %s; want 5s", tr.IdleConnTimeout)
+	}
+	if tr.ResponseHeaderTimeout != 2*time.Second {
+		t.Errorf("ResponseHeaderTimeout = %s; want 2s", tr.ResponseHeaderTimeout)
+	}
+	if !tr.ForceAttemptHTTP2 {
+		t.Errorf("ForceAttemptHTTP2 = false; want true")
+	}
+}
+
+func TestNewTransportSeedsPoolSizeGauge(t *testing.T) {
+	newTransport("test-pool-size-gauge", TransportConfig{MaxIdleConnsPerHost: 3})
+
+	if got := testutil.ToFloat64(transportPoolSize.WithLabelValues("test-pool-size-gauge")); got != 3 {
+		t.Fatalf("transportPoolSize = %v; want 3", got)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestCountingRoundTripperTracksInUseConns(t *testing.T) {
+	const cluster = "test-in-use-conns"
+
+	rt := &countingRoundTripper{
+		cluster: cluster,
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if got := testutil.ToFloat64(transportInUseConns.WithLabelValues(cluster)); got != 1 {
+				t.Fatalf("transportInUseConns = %v while a request is in flight; want 1", got)
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+
+	req, err := http.NewRequest("GET", "http://example/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(transportInUseConns.WithLabelValues(cluster)); got != 0 {
+		t.Fatalf("transportInUseConns = %v after the request completed; want 0", got)
+	}
+}
+
+func TestCountingRoundTripperDecrementsOnError(t *testing.T) {
+	const cluster = "test-in-use-conns-error"
+
+	rt := &countingRoundTripper{
+		cluster: cluster,
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, &net.OpError{Op: "dial", Err: context.DeadlineExceeded}
+		}),
+	}
+
+	req, err := http.NewRequest("GET", "http://example/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatal("expected RoundTrip to propagate the underlying error")
+	}
+
+	if got := testutil.ToFloat64(transportInUseConns.WithLabelValues(cluster)); got != 0 {
+		t.Fatalf("transportInUseConns = %v after a failed request; want 0", got)
+	}
+}
+
+func TestNewHTTPClientUsesDefaultRequestTimeout(t *testing.T) {
+	tr := newTransport("test-client-timeout", TransportConfig{})
+	c := newHTTPClient("test-client-timeout", tr)
+
+	if c.Timeout != defaultRequestTimeout {
+		t.Fatalf("http.Client.Timeout = %s; want %s", c.Timeout, defaultRequestTimeout)
+	}
+}